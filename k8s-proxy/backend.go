@@ -0,0 +1,271 @@
+// Backend set: lets the proxy balance across several GPU servers instead of
+// a single -target, selecting among them with a pluggable policy and
+// steering around any that active health checks have marked unhealthy.
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backendState mirrors the shape of grpc-go's connectivity.State: a small
+// enum tracking whether a backend is currently safe to route to.
+type backendState int32
+
+const (
+	stateIdle backendState = iota
+	stateConnecting
+	stateReady
+	stateTransientFailure
+)
+
+func (s backendState) String() string {
+	switch s {
+	case stateIdle:
+		return "IDLE"
+	case stateConnecting:
+		return "CONNECTING"
+	case stateReady:
+		return "READY"
+	case stateTransientFailure:
+		return "TRANSIENT_FAILURE"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// backend is one GPU server in the pool, with an atomically updated health
+// state and a live count of connections currently routed to it.
+type backend struct {
+	addr        string
+	state       int32 // backendState, accessed atomically
+	activeConns int64 // atomic
+}
+
+func (b *backend) getState() backendState {
+	return backendState(atomic.LoadInt32(&b.state))
+}
+
+func (b *backend) setState(s backendState) {
+	atomic.StoreInt32(&b.state, int32(s))
+}
+
+// backendPool selects among a set of backends per policy and runs an
+// active health checker that keeps each backend's state up to date.
+//
+// The backend set is either the static list parsed from -targets, or, when
+// -targets names a DNS SRV record, a set kept current by periodic
+// re-resolution (see newSRVBackendPool) in the manner of grpc-go's
+// dns_resolver. backends is guarded by mu since the SRV path replaces it
+// out from under any in-flight pick/dialBackend/states call.
+type backendPool struct {
+	mu       sync.RWMutex
+	backends []*backend
+	policy   string
+	rrIndex  uint64 // atomic
+}
+
+func newBackendPool(addrs []string, policy string) *backendPool {
+	p := &backendPool{policy: policy}
+	for _, addr := range addrs {
+		p.backends = append(p.backends, &backend{addr: addr, state: int32(stateIdle)})
+	}
+	return p
+}
+
+// newSRVBackendPool resolves srvName once to populate the initial backend
+// set, then re-resolves it every refreshInterval, adding and removing
+// backends as the SRV answer changes without dropping the health state of
+// any backend that remains present.
+func newSRVBackendPool(srvName, policy string, refreshInterval time.Duration) (*backendPool, error) {
+	p := &backendPool{policy: policy}
+	if err := p.resolveSRV(srvName); err != nil {
+		return nil, err
+	}
+	go p.watchSRV(srvName, refreshInterval)
+	return p, nil
+}
+
+// resolveSRV looks up srvName and reconciles the backend set against the
+// answer. An empty service/proto pair tells net.LookupSRV to query srvName
+// directly rather than as "_service._proto.name", matching the way
+// grpc-go's dns_resolver treats its target name.
+func (p *backendPool) resolveSRV(srvName string) error {
+	_, srvs, err := net.LookupSRV("", "", srvName)
+	if err != nil {
+		return fmt.Errorf("srv: resolving %q: %w", srvName, err)
+	}
+
+	addrs := make([]string, 0, len(srvs))
+	for _, srv := range srvs {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+	}
+	p.reconcile(addrs)
+	return nil
+}
+
+func (p *backendPool) watchSRV(srvName string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := p.resolveSRV(srvName); err != nil {
+			log.Printf("srv: re-resolving %q: %v", srvName, err)
+		}
+	}
+}
+
+// reconcile replaces the backend set with one matching addrs, reusing the
+// existing *backend (and its health state) for any address still present
+// so a routine re-resolution doesn't churn backends that didn't change.
+func (p *backendPool) reconcile(addrs []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	existing := make(map[string]*backend, len(p.backends))
+	for _, b := range p.backends {
+		existing[b.addr] = b
+	}
+
+	next := make([]*backend, 0, len(addrs))
+	seen := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		seen[addr] = true
+		if b, ok := existing[addr]; ok {
+			next = append(next, b)
+			continue
+		}
+		log.Printf("srv: backend %s added", addr)
+		next = append(next, &backend{addr: addr, state: int32(stateIdle)})
+	}
+	for _, b := range p.backends {
+		if !seen[b.addr] {
+			log.Printf("srv: backend %s removed", b.addr)
+		}
+	}
+
+	p.backends = next
+}
+
+func (p *backendPool) snapshot() []*backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*backend(nil), p.backends...)
+}
+
+// startHealthChecks dials every backend on an interval and updates its
+// state based on whether the dial succeeds.
+func (p *backendPool) startHealthChecks(interval, timeout time.Duration) {
+	check := func(b *backend) {
+		prev := b.getState()
+		if prev == stateIdle {
+			b.setState(stateConnecting)
+		}
+		conn, err := net.DialTimeout("tcp", b.addr, timeout)
+		if err != nil {
+			if prev != stateTransientFailure {
+				log.Printf("health: backend %s is unhealthy: %v", b.addr, err)
+			}
+			b.setState(stateTransientFailure)
+			return
+		}
+		conn.Close()
+		if prev != stateReady {
+			log.Printf("health: backend %s is healthy", b.addr)
+		}
+		b.setState(stateReady)
+	}
+
+	for _, b := range p.snapshot() {
+		check(b)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, b := range p.snapshot() {
+				check(b)
+			}
+		}
+	}()
+}
+
+// pick selects a Ready backend not present in exclude, per the pool's
+// policy. It returns an error if no Ready backend is available.
+func (p *backendPool) pick(exclude map[string]bool) (*backend, error) {
+	all := p.snapshot()
+
+	var candidates []*backend
+	for _, b := range all {
+		if b.getState() == stateReady && !exclude[b.addr] {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no healthy backend available")
+	}
+
+	switch p.policy {
+	case "pick_first":
+		return candidates[0], nil
+	case "least_conn":
+		best := candidates[0]
+		for _, b := range candidates[1:] {
+			if atomic.LoadInt64(&b.activeConns) < atomic.LoadInt64(&best.activeConns) {
+				best = b
+			}
+		}
+		return best, nil
+	default: // round_robin
+		idx := atomic.AddUint64(&p.rrIndex, 1)
+		return candidates[idx%uint64(len(candidates))], nil
+	}
+}
+
+// states returns a compact summary of each backend's state, suitable for
+// inclusion in the periodic stats log line.
+func (p *backendPool) states() string {
+	all := p.snapshot()
+	parts := make([]string, len(all))
+	for i, b := range all {
+		parts[i] = fmt.Sprintf("%s=%s", b.addr, b.getState())
+	}
+	return strings.Join(parts, " ")
+}
+
+// dialBackend tries up to maxRetries+1 distinct Ready backends, returning
+// the connection and the backend it landed on so the caller can track
+// activeConns for the duration of the session.
+func (p *backendPool) dialBackend(timeout time.Duration, maxRetries int) (net.Conn, *backend, error) {
+	excluded := make(map[string]bool)
+	var lastErr error
+
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		b, err := p.pick(excluded)
+		if err != nil {
+			if lastErr != nil {
+				return nil, nil, fmt.Errorf("%w (last dial error: %v)", err, lastErr)
+			}
+			return nil, nil, err
+		}
+
+		conn, err := timedDialTimeout("tcp", b.addr, timeout)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", b.addr, err)
+			excluded[b.addr] = true
+			b.setState(stateTransientFailure)
+			continue
+		}
+
+		atomic.AddInt64(&b.activeConns, 1)
+		return conn, b, nil
+	}
+
+	return nil, nil, fmt.Errorf("exhausted %d backend attempts: %w", maxRetries+1, lastErr)
+}
@@ -0,0 +1,236 @@
+// Embedded diagnostic agent, in the spirit of google/gops: a tiny TCP
+// protocol for introspecting a running proxy process without shelling into
+// the pod. Each request is a single command byte; each reply is a
+// length-prefixed payload so a small CLI (or `nc`) can read it off.
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	diagCmdStacks      = 0x01
+	diagCmdMemStats    = 0x02
+	diagCmdCPUProfile  = 0x03
+	diagCmdHeapProfile = 0x06
+	diagCmdTrace       = 0x07
+	diagCmdStats       = 0x10
+)
+
+// connStat tracks a single proxied connection for the diagnostic agent's
+// stats snapshot.
+type connStat struct {
+	connID   int64
+	remote   string
+	start    time.Time
+	bytesIn  int64 // atomic
+	bytesOut int64 // atomic
+}
+
+var connRegistry sync.Map // map[int64]*connStat
+
+func registerConn(connID int64, remote string) *connStat {
+	cs := &connStat{connID: connID, remote: remote, start: time.Now()}
+	connRegistry.Store(connID, cs)
+	return cs
+}
+
+func unregisterConn(connID int64) {
+	connRegistry.Delete(connID)
+}
+
+// countingWriter wraps an io.Writer, atomically accumulating the number of
+// bytes written into counter so the diagnostic agent can report live
+// per-connection byte counts instead of only a total at close.
+type countingWriter struct {
+	w       io.Writer
+	counter *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.counter, int64(n))
+	return n, err
+}
+
+// connStatRow is the JSON shape returned for each active connection by the
+// 0x10 stats command.
+type connStatRow struct {
+	ConnID   int64   `json:"connId"`
+	Remote   string  `json:"remote"`
+	BytesIn  int64   `json:"bytesIn"`
+	BytesOut int64   `json:"bytesOut"`
+	AgeSec   float64 `json:"ageSeconds"`
+}
+
+type diagStatsSnapshot struct {
+	ActiveConns int64         `json:"activeConns"`
+	TotalConns  int64         `json:"totalConns"`
+	TotalBytes  int64         `json:"totalBytes"`
+	Conns       []connStatRow `json:"conns"`
+}
+
+var cpuProfileMu sync.Mutex
+var cpuProfiling bool
+
+// runDiagAgent listens on addr and serves diagnostic commands until the
+// listener is closed (e.g. on shutdown).
+func runDiagAgent(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleDiagConn(conn)
+		}
+	}()
+
+	log.Printf("diag: agent listening on %s", addr)
+	return l, nil
+}
+
+func handleDiagConn(conn net.Conn) {
+	defer conn.Close()
+
+	cmd := make([]byte, 1)
+	if _, err := conn.Read(cmd); err != nil {
+		return
+	}
+
+	switch cmd[0] {
+	case diagCmdStacks:
+		writeDiagProfile(conn, "goroutine")
+	case diagCmdMemStats:
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		writeDiagJSON(conn, m)
+	case diagCmdCPUProfile:
+		writeDiagCPUProfile(conn)
+	case diagCmdHeapProfile:
+		writeDiagProfile(conn, "heap")
+	case diagCmdTrace:
+		writeDiagTrace(conn)
+	case diagCmdStats:
+		writeDiagJSON(conn, diagStatsSnapshot{
+			ActiveConns: atomic.LoadInt64(&activeConns),
+			TotalConns:  atomic.LoadInt64(&totalConns),
+			TotalBytes:  atomic.LoadInt64(&totalBytes),
+			Conns:       diagConnRows(),
+		})
+	default:
+		log.Printf("diag: unknown command 0x%02x from %s", cmd[0], conn.RemoteAddr())
+	}
+}
+
+func diagConnRows() []connStatRow {
+	var rows []connStatRow
+	connRegistry.Range(func(_, v interface{}) bool {
+		cs := v.(*connStat)
+		rows = append(rows, connStatRow{
+			ConnID:   cs.connID,
+			Remote:   cs.remote,
+			BytesIn:  atomic.LoadInt64(&cs.bytesIn),
+			BytesOut: atomic.LoadInt64(&cs.bytesOut),
+			AgeSec:   time.Since(cs.start).Seconds(),
+		})
+		return true
+	})
+	return rows
+}
+
+func writeDiagProfile(conn net.Conn, name string) {
+	p := pprof.Lookup(name)
+	if p == nil {
+		writeDiagFrame(conn, nil)
+		return
+	}
+	var buf bufferWriter
+	if err := p.WriteTo(&buf, 0); err != nil {
+		log.Printf("diag: writing %s profile: %v", name, err)
+		return
+	}
+	writeDiagFrame(conn, buf.data)
+}
+
+func writeDiagCPUProfile(conn net.Conn) {
+	cpuProfileMu.Lock()
+	if cpuProfiling {
+		cpuProfileMu.Unlock()
+		writeDiagFrame(conn, []byte("cpu profile already in progress"))
+		return
+	}
+	cpuProfiling = true
+	cpuProfileMu.Unlock()
+
+	var buf bufferWriter
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		cpuProfileMu.Lock()
+		cpuProfiling = false
+		cpuProfileMu.Unlock()
+		writeDiagFrame(conn, []byte("failed to start cpu profile: "+err.Error()))
+		return
+	}
+
+	time.Sleep(30 * time.Second)
+	pprof.StopCPUProfile()
+
+	cpuProfileMu.Lock()
+	cpuProfiling = false
+	cpuProfileMu.Unlock()
+
+	writeDiagFrame(conn, buf.data)
+}
+
+func writeDiagTrace(conn net.Conn) {
+	var buf bufferWriter
+	if err := trace.Start(&buf); err != nil {
+		writeDiagFrame(conn, []byte("failed to start trace: "+err.Error()))
+		return
+	}
+	time.Sleep(30 * time.Second)
+	trace.Stop()
+	writeDiagFrame(conn, buf.data)
+}
+
+func writeDiagJSON(conn net.Conn, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("diag: marshaling response: %v", err)
+		return
+	}
+	writeDiagFrame(conn, payload)
+}
+
+func writeDiagFrame(conn net.Conn, payload []byte) {
+	if err := binary.Write(conn, binary.BigEndian, uint32(len(payload))); err != nil {
+		return
+	}
+	conn.Write(payload)
+}
+
+// bufferWriter is a minimal growable byte buffer satisfying io.Writer,
+// used to capture profile/trace output before framing it.
+type bufferWriter struct {
+	data []byte
+}
+
+func (b *bufferWriter) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	return len(p), nil
+}
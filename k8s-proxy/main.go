@@ -3,19 +3,23 @@
 // Designed to run in K8s to bridge NEWT tunnel to an external GPU server.
 //
 // Usage: glados-proxy -target GPU_SERVER_IP:5555 -listen :5555
-//
 package main
 
 import (
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 var (
@@ -23,12 +27,58 @@ var (
 	targetAddr  = flag.String("target", "", "Target GPU server address (e.g., 192.168.1.100:5555)")
 	dialTimeout = flag.Duration("timeout", 10*time.Second, "Connection timeout to target")
 	bufferSize  = flag.Int("buffer", 32*1024, "Buffer size for copying data")
+
+	proxyProtocol       = flag.String("proxy-protocol", "off", "Send a PROXY protocol header to the target before forwarding data (off | v1 | v2)")
+	acceptProxyProtocol = flag.Bool("accept-proxy-protocol", false, "Expect a PROXY protocol header (v1 or v2) on incoming connections and use it as the logged client address")
+
+	mux          = flag.String("mux", "", "Multiplex client connections over a pool of persistent sessions to the target (\"\" | yamux)")
+	muxSessions  = flag.Int("mux-sessions", 4, "Number of persistent multiplexed sessions to keep open to the target")
+	muxKeepalive = flag.Duration("mux-keepalive", 30*time.Second, "Keepalive interval for multiplexed sessions")
+	muxServer    = flag.Bool("mux-server", false, "Accept a multiplexed transport on -listen and fan out streams to -target, instead of proxying raw TCP connections")
+
+	diagAddr = flag.String("diag-addr", "", "Address for the diagnostic agent to listen on (e.g. 127.0.0.1:6060); disabled if empty")
+
+	targetsFlag    = flag.String("targets", "", "Backend set, either a comma-separated set of addresses (gpu1:5555,gpu2:5555) or, prefixed with \"srv:\", a DNS SRV name re-resolved every -targets-refresh (à la grpc-go's dns_resolver), e.g. srv:_glados._tcp.example.com (overrides -target)")
+	lbPolicy       = flag.String("lb-policy", "round_robin", "Backend selection policy when -targets has more than one address (round_robin | least_conn | pick_first)")
+	healthInterval = flag.Duration("health-interval", 5*time.Second, "Interval between active backend health checks")
+	maxDialRetries = flag.Int("max-dial-retries", 2, "Number of alternate backends to try before giving up on a connection")
+	targetsRefresh = flag.Duration("targets-refresh", 30*time.Second, "Re-resolution interval for a \"srv:\" -targets name")
+
+	metricsAddr = flag.String("metrics-addr", "", "Address for a Prometheus /metrics endpoint (e.g. :9090); disabled if empty")
+
+	tlsCert = flag.String("tls-cert", "", "TLS certificate file used to terminate TLS from clients")
+	tlsKey  = flag.String("tls-key", "", "TLS private key file paired with -tls-cert")
+
+	targetTLS        = flag.Bool("target-tls", false, "Initiate TLS (optionally mutual) to the target instead of plain TCP")
+	targetCA         = flag.String("target-ca", "", "CA bundle used to verify the target's certificate when -target-tls is set")
+	targetClientCert = flag.String("target-client-cert", "", "Client certificate presented to the target for mTLS")
+	targetClientKey  = flag.String("target-client-key", "", "Client private key paired with -target-client-cert")
+
+	sniRouting = flag.Bool("sni-routing", false, "Peek the TLS ClientHello SNI and route to a backend from -sni-map without decrypting")
+	sniMap     = flag.String("sni-map", "", "Comma-separated host=target pairs used by -sni-routing, e.g. a.example.com=10.0.0.1:5555,b.example.com=10.0.0.2:5555")
+
+	maxConns         = flag.Int("max-conns", 0, "Reject new connections once this many are active (0 = unlimited)")
+	maxConnsPerIP    = flag.Int("max-conns-per-ip", 0, "Reject new connections once a client IP has this many active (0 = unlimited)")
+	rateLimitFlag    = flag.String("rate-limit", "", "Per-connection bandwidth cap in each direction, e.g. 10MB/s (empty = unlimited)")
+	globalRateLimitF = flag.String("global-rate-limit", "", "Aggregate bandwidth cap across all connections, e.g. 100MB/s (empty = unlimited)")
+)
+
+var sniTargets map[string]string
+
+var (
+	connRateBytesPerSec float64
+	globalLimiter       *rate.Limiter
+)
+
+var (
+	pool     *muxPool
+	backends *backendPool
 )
 
 var (
-	activeConns   int64
-	totalConns    int64
-	totalBytes    int64
+	activeConns int64
+	totalConns  int64
+	totalBytes  int64
 )
 
 func main() {
@@ -39,21 +89,119 @@ func main() {
 		*targetAddr = envTarget
 	}
 
-	if *targetAddr == "" {
-		log.Fatal("Error: -target or GLADOS_TARGET environment variable is required")
+	if *targetAddr == "" && *targetsFlag == "" {
+		log.Fatal("Error: -target, -targets, or GLADOS_TARGET environment variable is required")
+	}
+
+	if *targetsFlag != "" {
+		switch *lbPolicy {
+		case "round_robin", "least_conn", "pick_first":
+		default:
+			log.Fatalf("Error: -lb-policy must be one of round_robin, least_conn, pick_first (got %q)", *lbPolicy)
+		}
+
+		if srvName, ok := strings.CutPrefix(*targetsFlag, "srv:"); ok {
+			var err error
+			backends, err = newSRVBackendPool(srvName, *lbPolicy, *targetsRefresh)
+			if err != nil {
+				log.Fatalf("Error: -targets %q: %v", *targetsFlag, err)
+			}
+		} else {
+			var addrs []string
+			for _, addr := range strings.Split(*targetsFlag, ",") {
+				if addr = strings.TrimSpace(addr); addr != "" {
+					addrs = append(addrs, addr)
+				}
+			}
+			backends = newBackendPool(addrs, *lbPolicy)
+		}
+		backends.startHealthChecks(*healthInterval, *dialTimeout)
+	}
+
+	switch *proxyProtocol {
+	case "off", "v1", "v2":
+	default:
+		log.Fatalf("Error: -proxy-protocol must be one of off, v1, v2 (got %q)", *proxyProtocol)
+	}
+
+	switch *mux {
+	case "", "yamux":
+	default:
+		log.Fatalf("Error: -mux must be \"\" or yamux (got %q)", *mux)
+	}
+	if *mux != "" && *muxSessions < 1 {
+		log.Fatal("Error: -mux-sessions must be at least 1")
+	}
+	if *mux != "" {
+		pool = newMuxPool(*muxSessions)
+	}
+
+	if *sniRouting {
+		if *sniMap == "" {
+			log.Fatal("Error: -sni-routing requires -sni-map")
+		}
+		var err error
+		sniTargets, err = parseSNIMap(*sniMap)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+
+	if *rateLimitFlag != "" {
+		r, err := parseRate(*rateLimitFlag)
+		if err != nil {
+			log.Fatalf("Error: -rate-limit: %v", err)
+		}
+		connRateBytesPerSec = r
+	}
+	if *globalRateLimitF != "" {
+		r, err := parseRate(*globalRateLimitF)
+		if err != nil {
+			log.Fatalf("Error: -global-rate-limit: %v", err)
+		}
+		globalLimiter = newByteLimiter(r)
 	}
 
 	log.Printf("GLaDOS TCP Proxy starting...")
 	log.Printf("  Listen: %s", *listenAddr)
-	log.Printf("  Target: %s", *targetAddr)
+	if backends != nil {
+		log.Printf("  Targets: %s (policy=%s)", *targetsFlag, *lbPolicy)
+	} else {
+		log.Printf("  Target: %s", *targetAddr)
+	}
 
 	listener, err := net.Listen("tcp", *listenAddr)
 	if err != nil {
 		log.Fatalf("Failed to listen on %s: %v", *listenAddr, err)
 	}
+
+	if *tlsCert != "" && !*sniRouting {
+		tlsConfig, err := loadServerTLSConfig()
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+		log.Printf("  TLS: terminating client connections with %s", *tlsCert)
+	}
 	defer listener.Close()
 
-	log.Printf("Proxy ready, forwarding connections to %s", *targetAddr)
+	if backends != nil {
+		log.Printf("Proxy ready, forwarding connections to %s", *targetsFlag)
+	} else {
+		log.Printf("Proxy ready, forwarding connections to %s", *targetAddr)
+	}
+
+	if *metricsAddr != "" {
+		runMetricsServer(*metricsAddr)
+	}
+
+	var diagListener net.Listener
+	if *diagAddr != "" {
+		diagListener, err = runDiagAgent(*diagAddr)
+		if err != nil {
+			log.Fatalf("Failed to start diagnostic agent on %s: %v", *diagAddr, err)
+		}
+	}
 
 	// Handle graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -63,19 +211,36 @@ func main() {
 		<-sigChan
 		log.Printf("Shutting down... (active connections: %d)", atomic.LoadInt64(&activeConns))
 		listener.Close()
+		if diagListener != nil {
+			diagListener.Close()
+		}
 	}()
 
 	// Stats logger
 	go func() {
 		ticker := time.NewTicker(30 * time.Second)
 		for range ticker.C {
-			log.Printf("Stats: active=%d total=%d bytes=%d",
-				atomic.LoadInt64(&activeConns),
-				atomic.LoadInt64(&totalConns),
-				atomic.LoadInt64(&totalBytes))
+			if backends != nil {
+				log.Printf("Stats: active=%d total=%d bytes=%d backends=[%s]",
+					atomic.LoadInt64(&activeConns),
+					atomic.LoadInt64(&totalConns),
+					atomic.LoadInt64(&totalBytes),
+					backends.states())
+			} else {
+				log.Printf("Stats: active=%d total=%d bytes=%d",
+					atomic.LoadInt64(&activeConns),
+					atomic.LoadInt64(&totalConns),
+					atomic.LoadInt64(&totalBytes))
+			}
 		}
 	}()
 
+	if *muxServer {
+		runMuxServer(listener)
+		log.Printf("Proxy stopped")
+		return
+	}
+
 	// Accept connections
 	for {
 		clientConn, err := listener.Accept()
@@ -87,29 +252,93 @@ func main() {
 			continue
 		}
 
-		go handleConnection(clientConn)
+		if *sniRouting {
+			go dispatchSNIRoutedConnection(clientConn)
+		} else {
+			go handleConnection(clientConn, "")
+		}
 	}
 
 	log.Printf("Proxy stopped")
 }
 
-func handleConnection(clientConn net.Conn) {
+// dispatchSNIRoutedConnection peeks the TLS ClientHello's SNI to pick a
+// backend from -sni-map, then hands the (still-encrypted) connection to
+// handleConnection with that backend as a forced override.
+func dispatchSNIRoutedConnection(clientConn net.Conn) {
+	remote := clientConn.RemoteAddr().String()
+
+	host, wrapped, err := peekSNI(clientConn)
+	if err != nil {
+		log.Printf("sni-routing: failed to read ClientHello from %s: %v", remote, err)
+		clientConn.Close()
+		return
+	}
+
+	target, ok := sniTargets[host]
+	if !ok {
+		log.Printf("sni-routing: no target configured for host %q (from %s)", host, remote)
+		wrapped.Close()
+		return
+	}
+
+	handleConnection(wrapped, target)
+}
+
+func handleConnection(clientConn net.Conn, targetOverride string) {
 	connID := atomic.AddInt64(&totalConns, 1)
 	atomic.AddInt64(&activeConns, 1)
 	defer atomic.AddInt64(&activeConns, -1)
 
+	if *maxConns > 0 && atomic.LoadInt64(&activeConns) > int64(*maxConns) {
+		log.Printf("[%d] Rejecting connection from %s: max-conns (%d) reached", connID, clientConn.RemoteAddr(), *maxConns)
+		clientConn.Close()
+		return
+	}
+
+	if *acceptProxyProtocol {
+		wrapped, err := readProxyHeader(clientConn)
+		if err != nil {
+			log.Printf("[%d] Failed to read PROXY protocol header: %v", connID, err)
+			clientConn.Close()
+			return
+		}
+		clientConn = wrapped
+	}
+
 	clientAddr := clientConn.RemoteAddr().String()
+
+	var clientIP string
+	if *maxConnsPerIP > 0 {
+		host, _, err := net.SplitHostPort(clientAddr)
+		if err == nil {
+			clientIP = host
+		}
+		if !perIPConns.tryAcquire(clientIP, *maxConnsPerIP) {
+			log.Printf("[%d] Rejecting connection from %s: max-conns-per-ip (%d) reached", connID, clientAddr, *maxConnsPerIP)
+			clientConn.Close()
+			return
+		}
+		defer perIPConns.release(clientIP)
+	}
+
 	log.Printf("[%d] New connection from %s", connID, clientAddr)
 
+	cs := registerConn(connID, clientAddr)
+	defer unregisterConn(connID)
+
 	// Connect to target GPU server
-	targetConn, err := net.DialTimeout("tcp", *targetAddr, *dialTimeout)
+	targetConn, targetAddrUsed, targetBackend, err := dialTarget(targetOverride, clientConn.RemoteAddr(), clientConn.LocalAddr())
 	if err != nil {
-		log.Printf("[%d] Failed to connect to target %s: %v", connID, *targetAddr, err)
+		log.Printf("[%d] Failed to connect to target: %v", connID, err)
 		clientConn.Close()
 		return
 	}
+	if targetBackend != nil {
+		defer atomic.AddInt64(&targetBackend.activeConns, -1)
+	}
 
-	log.Printf("[%d] Connected to target %s", connID, *targetAddr)
+	log.Printf("[%d] Connected to target %s", connID, targetAddrUsed)
 
 	// Disable Nagle's algorithm for lower latency
 	if tc, ok := clientConn.(*net.TCPConn); ok {
@@ -129,23 +358,23 @@ func handleConnection(clientConn net.Conn) {
 
 	// Client -> Target
 	go func() {
-		n, err := copyBuffer(targetConn, clientConn)
+		n, err := copyBuffer(shapeWriter(&countingWriter{targetConn, &cs.bytesIn}), clientConn)
 		bytesIn = n
 		if err != nil {
 			log.Printf("[%d] Client->Target error: %v", connID, err)
 		}
 		// Signal the other direction to stop
-		targetConn.(*net.TCPConn).CloseWrite()
+		closeWrite(targetConn)
 		close(done)
 	}()
 
 	// Target -> Client (runs in main goroutine for this connection)
-	n, err := copyBuffer(clientConn, targetConn)
+	n, err := copyBuffer(shapeWriter(&countingWriter{clientConn, &cs.bytesOut}), targetConn)
 	bytesOut = n
 	if err != nil {
 		log.Printf("[%d] Target->Client error: %v", connID, err)
 	}
-	clientConn.(*net.TCPConn).CloseWrite()
+	closeWrite(clientConn)
 
 	// Wait for the other direction to finish
 	<-done
@@ -156,10 +385,77 @@ func handleConnection(clientConn net.Conn) {
 	totalBytesTransferred := bytesIn + bytesOut
 	atomic.AddInt64(&totalBytes, totalBytesTransferred)
 
+	recordBytes("in", targetAddrUsed, bytesIn)
+	recordBytes("out", targetAddrUsed, bytesOut)
+	connDurationSeconds.observe(time.Since(cs.start).Seconds())
+
 	log.Printf("[%d] Connection closed (in=%d out=%d bytes)", connID, bytesIn, bytesOut)
 }
 
+// dialTarget obtains a connection to the target GPU server for a single
+// client: a direct dial to override when set (used by -sni-routing), a
+// balanced dial across -targets, a plain TCP dial to -target, or a stream
+// over a pooled mux session when -mux is set. It returns the address that
+// was actually connected to (for logging) and, when a backend set is in
+// use, the backend so the caller can track its activeConns for the life of
+// the connection.
+//
+// When -proxy-protocol is set, the header is written on the raw connection
+// before any TLS upgrade, since it must arrive as cleartext preamble ahead
+// of the TLS handshake for a PROXY-aware terminator to parse it. Only then,
+// if -target-tls is set, is the connection upgraded to TLS.
+func dialTarget(override string, srcAddr, dstAddr net.Addr) (net.Conn, string, *backend, error) {
+	conn, addr, b, err := rawDialTarget(override)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	if *proxyProtocol != "off" {
+		if err := writeProxyHeader(conn, *proxyProtocol, srcAddr, dstAddr); err != nil {
+			conn.Close()
+			return nil, "", nil, fmt.Errorf("writing PROXY protocol header to target: %w", err)
+		}
+	}
+
+	conn, err = maybeWrapTargetTLS(conn, addr)
+	if err != nil {
+		conn.Close()
+		return nil, "", nil, err
+	}
+	return conn, addr, b, nil
+}
+
+func rawDialTarget(override string) (net.Conn, string, *backend, error) {
+	if override != "" {
+		conn, err := timedDialTimeout("tcp", override, *dialTimeout)
+		return conn, override, nil, err
+	}
+	if backends != nil {
+		conn, b, err := backends.dialBackend(*dialTimeout, *maxDialRetries)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return conn, b.addr, b, nil
+	}
+	if pool != nil {
+		conn, err := pool.open()
+		return conn, *targetAddr, nil, err
+	}
+	conn, err := timedDialTimeout("tcp", *targetAddr, *dialTimeout)
+	return conn, *targetAddr, nil, err
+}
+
 func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
 	buf := make([]byte, *bufferSize)
 	return io.CopyBuffer(dst, src, buf)
 }
+
+// closeWrite half-closes conn for writing if it supports CloseWrite, e.g. a
+// *net.TCPConn or a *tls.Conn. Connections that don't support it (such as
+// proxyProtoConn and sniPeekConn, which embed a plain net.Conn) are left for
+// the caller's final Close.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
@@ -0,0 +1,121 @@
+// Prometheus-format /metrics endpoint. Kept dependency-free (hand-rolled
+// text exposition format) rather than pulling in client_golang.
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	dialSeconds         = newHistogram([]float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5})
+	connDurationSeconds = newHistogram([]float64{0.1, 0.5, 1, 5, 30, 60, 300, 900})
+
+	byteCounters sync.Map // map[string]*int64, key "direction|backend"
+)
+
+// timedDialTimeout wraps net.DialTimeout, recording the dial's duration in
+// the glados_proxy_dial_seconds histogram regardless of outcome.
+func timedDialTimeout(network, addr string, timeout time.Duration) (net.Conn, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout(network, addr, timeout)
+	dialSeconds.observe(time.Since(start).Seconds())
+	return conn, err
+}
+
+// recordBytes adds n to the running total transferred in direction
+// ("in" | "out") for backend.
+func recordBytes(direction, backend string, n int64) {
+	key := direction + "|" + backend
+	v, _ := byteCounters.LoadOrStore(key, new(int64))
+	atomic.AddInt64(v.(*int64), n)
+}
+
+// histogram is a minimal Prometheus-style cumulative histogram.
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []int64
+	sum     float64
+	count   int64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]int64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sum += v
+	h.count++
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+}
+
+func (h *histogram) writeTo(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// runMetricsServer starts an HTTP server exposing /metrics in Prometheus
+// text format. It runs until the process exits; there is no separate
+// shutdown hook since net/http has no in-place listener swap to clean up.
+func runMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	log.Printf("metrics: serving /metrics on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("metrics: server failed: %v", err)
+		}
+	}()
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "# HELP glados_proxy_connections_total Total client connections accepted.\n")
+	fmt.Fprintf(w, "# TYPE glados_proxy_connections_total counter\n")
+	fmt.Fprintf(w, "glados_proxy_connections_total %d\n", atomic.LoadInt64(&totalConns))
+
+	fmt.Fprintf(w, "# HELP glados_proxy_active_connections Connections currently being proxied.\n")
+	fmt.Fprintf(w, "# TYPE glados_proxy_active_connections gauge\n")
+	fmt.Fprintf(w, "glados_proxy_active_connections %d\n", atomic.LoadInt64(&activeConns))
+
+	fmt.Fprintf(w, "# HELP glados_proxy_bytes_total Bytes proxied, by direction and backend.\n")
+	fmt.Fprintf(w, "# TYPE glados_proxy_bytes_total counter\n")
+	var keys []string
+	byteCounters.Range(func(k, _ interface{}) bool {
+		keys = append(keys, k.(string))
+		return true
+	})
+	sort.Strings(keys)
+	for _, key := range keys {
+		v, _ := byteCounters.Load(key)
+		parts := strings.SplitN(key, "|", 2)
+		fmt.Fprintf(w, "glados_proxy_bytes_total{direction=%q,backend=%q} %d\n",
+			parts[0], parts[1], atomic.LoadInt64(v.(*int64)))
+	}
+
+	dialSeconds.writeTo(w, "glados_proxy_dial_seconds", "Time to dial a backend.")
+	connDurationSeconds.writeTo(w, "glados_proxy_conn_duration_seconds", "Duration of proxied connections.")
+}
@@ -0,0 +1,123 @@
+// Connection multiplexing: instead of dialing a fresh TCP connection to the
+// target for every client, keep a small pool of long-lived yamux sessions
+// open and hand each client a logical stream on one of them. This amortizes
+// TCP + handshake setup cost across many short-lived GLaDOS requests, the
+// same trick frp uses for its tunnels.
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/yamux"
+)
+
+// muxPool maintains up to muxSessions persistent yamux client sessions to
+// *targetAddr, redialing lazily whenever a session has died.
+type muxPool struct {
+	mu       sync.Mutex
+	sessions []*yamux.Session
+	next     uint64
+}
+
+func newMuxPool(size int) *muxPool {
+	return &muxPool{sessions: make([]*yamux.Session, size)}
+}
+
+// open returns a new logical stream over one of the pool's sessions,
+// establishing that session first if needed.
+func (p *muxPool) open() (net.Conn, error) {
+	idx := int(atomic.AddUint64(&p.next, 1) % uint64(len(p.sessions)))
+
+	session, err := p.session(idx)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := session.Open()
+	if err != nil {
+		// The session is likely dead; drop it so the next caller redials.
+		p.mu.Lock()
+		if p.sessions[idx] == session {
+			p.sessions[idx] = nil
+		}
+		p.mu.Unlock()
+		return nil, fmt.Errorf("mux: opening stream on session %d: %w", idx, err)
+	}
+
+	return stream, nil
+}
+
+func (p *muxPool) session(idx int) (*yamux.Session, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.sessions[idx] != nil && !p.sessions[idx].IsClosed() {
+		return p.sessions[idx], nil
+	}
+
+	conn, err := timedDialTimeout("tcp", *targetAddr, *dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("mux: dialing %s for session %d: %w", *targetAddr, idx, err)
+	}
+
+	cfg := yamux.DefaultConfig()
+	cfg.EnableKeepAlive = true
+	cfg.KeepAliveInterval = *muxKeepalive
+
+	session, err := yamux.Client(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("mux: starting client session %d: %w", idx, err)
+	}
+
+	log.Printf("mux: session %d established to %s", idx, *targetAddr)
+	p.sessions[idx] = session
+	return session, nil
+}
+
+// runMuxServer is the -mux-server counterpart: it accepts the muxed
+// transport on listener, one yamux server session per accepted TCP
+// connection, and fans each logical stream out through the ordinary
+// handleConnection path (dialing the target via dialTarget as if the stream
+// itself were a client connection).
+func runMuxServer(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && opErr.Err.Error() == "use of closed network connection" {
+				return // Graceful shutdown
+			}
+			log.Printf("mux-server: accept error: %v", err)
+			continue
+		}
+
+		go serveMuxSessions(conn)
+	}
+}
+
+func serveMuxSessions(conn net.Conn) {
+	cfg := yamux.DefaultConfig()
+	cfg.EnableKeepAlive = true
+	cfg.KeepAliveInterval = *muxKeepalive
+
+	session, err := yamux.Server(conn, cfg)
+	if err != nil {
+		log.Printf("mux-server: failed to start session from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	log.Printf("mux-server: accepted session from %s", conn.RemoteAddr())
+
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			log.Printf("mux-server: session from %s closed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		go handleConnection(stream, "")
+	}
+}
@@ -0,0 +1,207 @@
+// PROXY protocol (HAProxy) support, v1 and v2, so that a backend behind
+// this proxy can recover the real client address instead of seeing the
+// proxy's own source IP.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyProtoV2Sig is the fixed 12-byte signature that opens every v2 header.
+var proxyProtoV2Sig = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// writeProxyHeader writes a PROXY protocol header for srcAddr/dstAddr to w,
+// in the format selected by version ("v1" or "v2"). It is a no-op for any
+// other value.
+func writeProxyHeader(w io.Writer, version string, srcAddr, dstAddr net.Addr) error {
+	switch version {
+	case "v1":
+		return writeProxyHeaderV1(w, srcAddr, dstAddr)
+	case "v2":
+		return writeProxyHeaderV2(w, srcAddr, dstAddr)
+	default:
+		return nil
+	}
+}
+
+func writeProxyHeaderV1(w io.Writer, srcAddr, dstAddr net.Addr) error {
+	src, ok := srcAddr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("proxy protocol v1: source is not a TCP address: %v", srcAddr)
+	}
+	dst, ok := dstAddr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("proxy protocol v1: destination is not a TCP address: %v", dstAddr)
+	}
+
+	proto := "TCP4"
+	if src.IP.To4() == nil {
+		proto = "TCP6"
+	}
+
+	line := fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, src.IP.String(), dst.IP.String(), src.Port, dst.Port)
+	_, err := io.WriteString(w, line)
+	return err
+}
+
+func writeProxyHeaderV2(w io.Writer, srcAddr, dstAddr net.Addr) error {
+	src, ok := srcAddr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("proxy protocol v2: source is not a TCP address: %v", srcAddr)
+	}
+	dst, ok := dstAddr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("proxy protocol v2: destination is not a TCP address: %v", dstAddr)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(proxyProtoV2Sig)
+	buf.WriteByte(0x21) // version 2, command PROXY
+
+	srcIP4, dstIP4 := src.IP.To4(), dst.IP.To4()
+	if srcIP4 != nil && dstIP4 != nil {
+		buf.WriteByte(0x11) // TCP over IPv4
+		binary.Write(&buf, binary.BigEndian, uint16(12))
+		buf.Write(srcIP4)
+		buf.Write(dstIP4)
+		binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+		binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+	} else {
+		buf.WriteByte(0x21) // TCP over IPv6
+		binary.Write(&buf, binary.BigEndian, uint16(36))
+		buf.Write(src.IP.To16())
+		buf.Write(dst.IP.To16())
+		binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+		binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// proxyProtoConn wraps a net.Conn whose PROXY protocol header has already
+// been consumed, so Read returns the remaining buffered application data
+// followed by the underlying connection.
+type proxyProtoConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader peeks at conn for a PROXY protocol v1 or v2 header and, if
+// found, returns a net.Conn that reports the real client address via
+// RemoteAddr and yields the remaining bytes on Read. It is used when
+// -accept-proxy-protocol is set and this proxy is itself behind something
+// (e.g. a NEWT tunnel) that forwards a PROXY header to us.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	br := bufio.NewReaderSize(conn, 256)
+
+	peek, err := br.Peek(len(proxyProtoV2Sig))
+	if err == nil && bytes.Equal(peek, proxyProtoV2Sig) {
+		addr, err := readProxyHeaderV2(br)
+		if err != nil {
+			return nil, err
+		}
+		return &proxyProtoConn{Conn: conn, r: br, remoteAddr: addr}, nil
+	}
+
+	peek, err = br.Peek(5)
+	if err == nil && string(peek) == "PROXY" {
+		addr, err := readProxyHeaderV1(br)
+		if err != nil {
+			return nil, err
+		}
+		return &proxyProtoConn{Conn: conn, r: br, remoteAddr: addr}, nil
+	}
+
+	// No recognizable header; hand back the buffered reader unchanged so
+	// none of the peeked bytes are lost.
+	return &proxyProtoConn{Conn: conn, r: br}, nil
+}
+
+// maxProxyV1HeaderLen is the longest a v1 header can be per spec (e.g.
+// "PROXY TCP6 ffff:...:ffff ffff:...:ffff 65535 65535\r\n").
+const maxProxyV1HeaderLen = 107
+
+func readProxyHeaderV1(br *bufio.Reader) (net.Addr, error) {
+	var buf bytes.Buffer
+	for buf.Len() < maxProxyV1HeaderLen {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxy protocol v1: %w", err)
+		}
+		buf.WriteByte(b)
+		if b == '\n' {
+			break
+		}
+	}
+	if buf.Len() == 0 || buf.Bytes()[buf.Len()-1] != '\n' {
+		return nil, fmt.Errorf("proxy protocol v1: header exceeds %d bytes without a terminating newline", maxProxyV1HeaderLen)
+	}
+
+	line := buf.String()
+	fields := strings.Fields(strings.TrimSpace(line))
+	if len(fields) != 6 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("proxy protocol v1: malformed header %q", line)
+	}
+
+	srcIP := net.ParseIP(fields[2])
+	srcPort, err := strconv.Atoi(fields[4])
+	if srcIP == nil || err != nil {
+		return nil, fmt.Errorf("proxy protocol v1: bad source address %q:%q", fields[2], fields[4])
+	}
+
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, nil
+}
+
+func readProxyHeaderV2(br *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("proxy protocol v2: %w", err)
+	}
+
+	fam := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	addrBytes := make([]byte, length)
+	if _, err := io.ReadFull(br, addrBytes); err != nil {
+		return nil, fmt.Errorf("proxy protocol v2: %w", err)
+	}
+
+	switch fam {
+	case 0x11: // TCP over IPv4
+		if length < 12 {
+			return nil, fmt.Errorf("proxy protocol v2: short IPv4 address block")
+		}
+		srcIP := net.IP(addrBytes[0:4])
+		srcPort := binary.BigEndian.Uint16(addrBytes[8:10])
+		return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, nil
+	case 0x21: // TCP over IPv6
+		if length < 36 {
+			return nil, fmt.Errorf("proxy protocol v2: short IPv6 address block")
+		}
+		srcIP := net.IP(addrBytes[0:16])
+		srcPort := binary.BigEndian.Uint16(addrBytes[32:34])
+		return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, nil
+	default:
+		return nil, fmt.Errorf("proxy protocol v2: unsupported address family 0x%02x", fam)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantIP  string
+		wantErr bool
+	}{
+		{name: "valid TCP4", input: "PROXY TCP4 192.168.1.1 192.168.1.2 5678 5555\r\n", wantIP: "192.168.1.1"},
+		{name: "valid TCP6", input: "PROXY TCP6 ::1 ::2 5678 5555\r\n", wantIP: "[::1]"},
+		{name: "missing newline, under limit", input: "PROXY TCP4 192.168.1.1 192.168.1.2 5678 5555", wantErr: true},
+		{name: "missing newline, never arrives", input: strings.Repeat("A", 200), wantErr: true},
+		{name: "too few fields", input: "PROXY TCP4 192.168.1.1\r\n", wantErr: true},
+		{name: "not PROXY", input: "GET / HTTP/1.1\r\n", wantErr: true},
+		{name: "bad source IP", input: "PROXY TCP4 not-an-ip 192.168.1.2 5678 5555\r\n", wantErr: true},
+		{name: "bad source port", input: "PROXY TCP4 192.168.1.1 192.168.1.2 not-a-port 5555\r\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(tt.input))
+			addr, err := readProxyHeaderV1(br)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readProxyHeaderV1(%q) = %v, want error", tt.input, addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProxyHeaderV1(%q) unexpected error: %v", tt.input, err)
+			}
+			if got := addr.String(); !strings.HasPrefix(got, tt.wantIP) {
+				t.Fatalf("readProxyHeaderV1(%q) = %q, want IP %q", tt.input, got, tt.wantIP)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderV1ExceedsLimit(t *testing.T) {
+	// A "PROXY ..." line with no newline within maxProxyV1HeaderLen bytes
+	// must fail the parse instead of blocking forever looking for '\n'.
+	input := "PROXY TCP4 " + strings.Repeat("1", maxProxyV1HeaderLen) + " 192.168.1.2 5678 5555\r\n"
+	br := bufio.NewReader(strings.NewReader(input))
+	if _, err := readProxyHeaderV1(br); err == nil {
+		t.Fatalf("readProxyHeaderV1 with an over-length header: got nil error, want one")
+	}
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	// readProxyHeaderV2 expects the full 16-byte v2 header (12-byte sig,
+	// ver/cmd byte, family byte, 2-byte address-block length) still in the
+	// reader, followed by the address block itself.
+	buildHeader := func(fam byte, addrLen uint16) *bytes.Buffer {
+		var buf bytes.Buffer
+		buf.Write(proxyProtoV2Sig)
+		buf.WriteByte(0x21) // version 2, command PROXY
+		buf.WriteByte(fam)
+		binary.Write(&buf, binary.BigEndian, addrLen)
+		return &buf
+	}
+
+	t.Run("valid IPv4", func(t *testing.T) {
+		buf := buildHeader(0x11, 12)
+		buf.Write([]byte{10, 0, 0, 1})                    // src IP
+		buf.Write([]byte{10, 0, 0, 2})                    // dst IP
+		binary.Write(buf, binary.BigEndian, uint16(1234)) // src port
+		binary.Write(buf, binary.BigEndian, uint16(5555)) // dst port
+
+		addr, err := readProxyHeaderV2(bufio.NewReader(buf))
+		if err != nil {
+			t.Fatalf("readProxyHeaderV2: %v", err)
+		}
+		if got := addr.String(); got != "10.0.0.1:1234" {
+			t.Fatalf("readProxyHeaderV2 = %q, want 10.0.0.1:1234", got)
+		}
+	})
+
+	t.Run("valid IPv6", func(t *testing.T) {
+		buf := buildHeader(0x21, 36)
+		buf.Write(net.ParseIP("::1").To16())
+		buf.Write(net.ParseIP("::2").To16())
+		binary.Write(buf, binary.BigEndian, uint16(1234))
+		binary.Write(buf, binary.BigEndian, uint16(5555))
+
+		addr, err := readProxyHeaderV2(bufio.NewReader(buf))
+		if err != nil {
+			t.Fatalf("readProxyHeaderV2: %v", err)
+		}
+		if got := addr.String(); got != "[::1]:1234" {
+			t.Fatalf("readProxyHeaderV2 = %q, want [::1]:1234", got)
+		}
+	})
+
+	t.Run("short IPv4 address block", func(t *testing.T) {
+		buf := buildHeader(0x11, 4)
+		buf.Write([]byte{1, 2, 3, 4})
+		if _, err := readProxyHeaderV2(bufio.NewReader(buf)); err == nil {
+			t.Fatal("readProxyHeaderV2 with a short IPv4 block: got nil error, want one")
+		}
+	})
+
+	t.Run("unsupported address family", func(t *testing.T) {
+		buf := buildHeader(0x00, 0)
+		if _, err := readProxyHeaderV2(bufio.NewReader(buf)); err == nil {
+			t.Fatal("readProxyHeaderV2 with family 0x00: got nil error, want one")
+		}
+	})
+
+	t.Run("truncated header", func(t *testing.T) {
+		if _, err := readProxyHeaderV2(bufio.NewReader(bytes.NewReader([]byte{0x11, 0x00}))); err == nil {
+			t.Fatal("readProxyHeaderV2 with a truncated header: got nil error, want one")
+		}
+	})
+}
@@ -0,0 +1,115 @@
+// Connection and bandwidth governors so a single client (or all of them
+// together) can't saturate the NEWT tunnel: caps on concurrent connections
+// overall and per client IP, plus per-connection and aggregate bandwidth
+// shaping.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// parseRate parses a bandwidth limit like "10MB/s" or "512KB/s" into
+// bytes per second. A bare number is interpreted as bytes/s.
+func parseRate(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimSuffix(s, "/s")
+
+	units := []struct {
+		suffix string
+		mult   float64
+	}{
+		{"GB", 1024 * 1024 * 1024},
+		{"MB", 1024 * 1024},
+		{"KB", 1024},
+		{"B", 1},
+	}
+
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(s, u.suffix), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid rate %q: %w", s, err)
+			}
+			return n * u.mult, nil
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q: %w", s, err)
+	}
+	return n, nil
+}
+
+// newByteLimiter builds a token-bucket limiter for bytesPerSec with a burst
+// large enough to admit a single buffer-sized write without WaitN erroring.
+func newByteLimiter(bytesPerSec float64) *rate.Limiter {
+	burst := int(bytesPerSec)
+	if burst < *bufferSize {
+		burst = *bufferSize
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+}
+
+// rateLimitedWriter wraps an io.Writer, blocking each Write until the
+// limiter has enough tokens for it.
+type rateLimitedWriter struct {
+	w       io.Writer
+	limiter *rate.Limiter
+}
+
+func (rw *rateLimitedWriter) Write(p []byte) (int, error) {
+	if err := rw.limiter.WaitN(context.Background(), len(p)); err != nil {
+		return 0, err
+	}
+	return rw.w.Write(p)
+}
+
+// shapeWriter wraps w with the configured global and per-connection
+// bandwidth limiters, in that order. Either or both may be absent.
+func shapeWriter(w io.Writer) io.Writer {
+	if globalLimiter != nil {
+		w = &rateLimitedWriter{w: w, limiter: globalLimiter}
+	}
+	if connRateBytesPerSec > 0 {
+		w = &rateLimitedWriter{w: w, limiter: newByteLimiter(connRateBytesPerSec)}
+	}
+	return w
+}
+
+// ipConnTracker enforces -max-conns-per-ip by counting concurrent
+// connections per client IP.
+type ipConnTracker struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var perIPConns = &ipConnTracker{counts: make(map[string]int)}
+
+// tryAcquire reports whether ip is under its limit and, if so, reserves a
+// slot for it. Callers that get true must call release once done.
+func (t *ipConnTracker) tryAcquire(ip string, limit int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.counts[ip] >= limit {
+		return false
+	}
+	t.counts[ip]++
+	return true
+}
+
+func (t *ipConnTracker) release(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.counts[ip]--
+	if t.counts[ip] <= 0 {
+		delete(t.counts, ip)
+	}
+}
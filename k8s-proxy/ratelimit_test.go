@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    float64
+		wantErr bool
+	}{
+		{name: "bare bytes", input: "1024", want: 1024},
+		{name: "bytes with unit", input: "512B/s", want: 512},
+		{name: "kilobytes", input: "10KB/s", want: 10 * 1024},
+		{name: "megabytes", input: "10MB/s", want: 10 * 1024 * 1024},
+		{name: "gigabytes", input: "2GB/s", want: 2 * 1024 * 1024 * 1024},
+		{name: "no /s suffix", input: "10MB", want: 10 * 1024 * 1024},
+		{name: "surrounding whitespace", input: "  10MB/s  ", want: 10 * 1024 * 1024},
+		{name: "garbage", input: "fast please", wantErr: true},
+		{name: "unit with no number", input: "MB/s", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRate(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseRate(%q) = %v, want error", tt.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRate(%q) unexpected error: %v", tt.input, err)
+			}
+			if got != tt.want {
+				t.Fatalf("parseRate(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
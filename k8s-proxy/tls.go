@@ -0,0 +1,141 @@
+// TLS support: terminating TLS from clients, initiating (optionally mutual)
+// TLS to the target backend, and SNI-based routing that picks a backend
+// from the ClientHello without decrypting anything.
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// loadServerTLSConfig builds the tls.Config used to terminate TLS from
+// clients on the listener, from -tls-cert / -tls-key.
+func loadServerTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return nil, fmt.Errorf("loading server certificate: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// buildTargetTLSConfig builds the tls.Config used to dial the target over
+// TLS, from -target-ca / -target-client-cert / -target-client-key.
+func buildTargetTLSConfig(serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: serverName}
+
+	if *targetCA != "" {
+		caPEM, err := os.ReadFile(*targetCA)
+		if err != nil {
+			return nil, fmt.Errorf("reading -target-ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in -target-ca %s", *targetCA)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if *targetClientCert != "" || *targetClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(*targetClientCert, *targetClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading target client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// maybeWrapTargetTLS upgrades conn to TLS when -target-tls is set.
+func maybeWrapTargetTLS(conn net.Conn, addr string) (net.Conn, error) {
+	if !*targetTLS {
+		return conn, nil
+	}
+
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+
+	cfg, err := buildTargetTLSConfig(host)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake with target %s: %w", addr, err)
+	}
+	return tlsConn, nil
+}
+
+// parseSNIMap parses a comma-separated "host=target,host=target" string
+// as used by -sni-map.
+func parseSNIMap(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("malformed -sni-map entry %q, want host=target", pair)
+		}
+		m[parts[0]] = parts[1]
+	}
+	return m, nil
+}
+
+var errSNIPeeked = errors.New("sni: stopped handshake after reading ClientHello")
+
+// sniPeekConn wraps a net.Conn with a reader that first replays the bytes
+// consumed while sniffing the TLS ClientHello, so they remain available to
+// whoever reads the connection next.
+type sniPeekConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniPeekConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// sniffConn drops writes, so the alert the sniffing tls.Server sends when
+// it aborts the handshake never reaches the client.
+type sniffConn struct{ *sniPeekConn }
+
+func (sniffConn) Write(b []byte) (int, error) { return len(b), nil }
+
+// peekSNI reads just enough of conn's TLS ClientHello to learn the SNI
+// server name, then hands back a connection that will yield the same bytes
+// again to the real TLS handshake performed by whoever it's routed to.
+// This lets the proxy route by hostname without terminating TLS itself.
+func peekSNI(conn net.Conn) (string, net.Conn, error) {
+	var hello bytes.Buffer
+	sniff := sniffConn{&sniPeekConn{Conn: conn, r: io.TeeReader(conn, &hello)}}
+
+	var sni string
+	var sniSeen bool
+	srv := tls.Server(sniff, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			sniSeen = true
+			return nil, errSNIPeeked
+		},
+	})
+
+	err := srv.Handshake()
+	if !sniSeen {
+		return "", nil, fmt.Errorf("sni: reading ClientHello: %w", err)
+	}
+
+	return sni, &sniPeekConn{Conn: conn, r: io.MultiReader(&hello, conn)}, nil
+}
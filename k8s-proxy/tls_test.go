@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSNIMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:  "single pair",
+			input: "a.example.com=10.0.0.1:5555",
+			want:  map[string]string{"a.example.com": "10.0.0.1:5555"},
+		},
+		{
+			name:  "multiple pairs with spacing",
+			input: "a.example.com=10.0.0.1:5555, b.example.com=10.0.0.2:5555",
+			want: map[string]string{
+				"a.example.com": "10.0.0.1:5555",
+				"b.example.com": "10.0.0.2:5555",
+			},
+		},
+		{
+			name:  "empty string",
+			input: "",
+			want:  map[string]string{},
+		},
+		{name: "missing target", input: "a.example.com=", wantErr: true},
+		{name: "missing host", input: "=10.0.0.1:5555", wantErr: true},
+		{name: "no equals sign", input: "a.example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSNIMap(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseSNIMap(%q) = %v, want error", tt.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSNIMap(%q) unexpected error: %v", tt.input, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseSNIMap(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}